@@ -8,7 +8,6 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"math/rand"
 	"path"
 	"time"
 
@@ -53,6 +52,37 @@ type RouteHints struct {
 	FeeBaseMsat               int64
 	FeeProportionalMillionths int64
 	CltvExpiryDelta           int32
+
+	// ChannelID is the short channel id of the real channel this hint
+	// advertises reachability through, distinct per peer/channel.
+	ChannelID int64
+}
+
+// RouteHintsList is a wrapper around a RouteHints slice to be able to pass
+// through the gomobile bridge.
+type RouteHintsList struct {
+	hints []*RouteHints
+}
+
+// NewRouteHintsList creates an empty RouteHintsList that hints can be
+// appended to with Add.
+func NewRouteHintsList() *RouteHintsList {
+	return &RouteHintsList{}
+}
+
+// Add appends a route hint to the list.
+func (l *RouteHintsList) Add(hint *RouteHints) {
+	l.hints = append(l.hints, hint)
+}
+
+// Length returns the number of hints in the list.
+func (l *RouteHintsList) Length() int {
+	return len(l.hints)
+}
+
+// Get returns the hint at the given index.
+func (l *RouteHintsList) Get(i int) *RouteHints {
+	return l.hints[i]
 }
 
 type OperationMetadata struct {
@@ -66,8 +96,49 @@ type InvoiceOptions struct {
 	Description string
 	AmountSat   int64
 	Metadata    *OperationMetadata
+
+	// IsHold marks the invoice as a hold invoice: CreateInvoice will not
+	// release its preimage automatically. The caller must later release it
+	// with SettleHoldInvoice once whatever off-chain condition gates the
+	// payment has been satisfied, or give up on it with CancelHoldInvoice.
+	IsHold bool
+
+	// Features is a bitmask of the InvoiceFeature* flags below. It defaults
+	// to 0, which sets only the always-on TLVOnionPayload/PaymentAddr bits.
+	Features int64
+
+	// MPPTotalAmt, when non-zero, overrides AmountSat as the total amount,
+	// in millisatoshis, that the sum of incoming HTLCs must reach before the
+	// invoice is considered settled, for multi-part payments.
+	MPPTotalAmt int64
+
+	// MPPMinShardMsat is the minimum size, in millisatoshis, accepted for an
+	// individual HTLC shard of a multi-part payment towards this invoice.
+	MPPMinShardMsat int64
+
+	// ExpirySeconds is how long the invoice is valid for, counted from its
+	// creation time. Defaults to DefaultInvoiceExpirySeconds when zero.
+	ExpirySeconds int64
+
+	// PaymentHash selects the exact unused hold invoice secret to build.
+	// Required when IsHold is true, since a hold invoice's payment hash is
+	// assigned externally and must match the secret registered with
+	// PersistHoldInvoiceSecrets. It is ignored when IsHold is false: a
+	// regular invoice always uses whichever unused secret sorts first.
+	PaymentHash []byte
 }
 
+// DefaultInvoiceExpirySeconds is used as InvoiceOptions.ExpirySeconds when
+// it isn't set explicitly.
+const DefaultInvoiceExpirySeconds = int64(time.Hour / time.Second)
+
+// Feature bit flags for InvoiceOptions.Features, mirroring the subset of
+// BOLT-9 feature bits CreateInvoice knows how to set.
+const (
+	InvoiceFeatureMPPOptional int64 = 1 << iota
+	InvoiceFeatureAMPOptional
+)
+
 // InvoiceSecretsList is a wrapper around an InvoiceSecrets slice to be
 // able to pass through the gomobile bridge.
 type InvoiceSecretsList struct {
@@ -152,11 +223,75 @@ func GenerateInvoiceSecrets(userKey, muunKey *HDPublicKey) (*InvoiceSecretsList,
 		})
 	}
 
-	// TODO: cleanup used secrets
+	// used/expired secrets are cleaned up by SweepInvoices, run periodically
+	// by the caller
 
 	return &InvoiceSecretsList{secrets}, nil
 }
 
+// GenerateHoldInvoiceSecrets returns the secrets needed to create a hold
+// invoice for paymentHash. Unlike GenerateInvoiceSecrets, the preimage is
+// not generated locally: it is supplied later via SettleHoldInvoice.
+func GenerateHoldInvoiceSecrets(userKey, muunKey *HDPublicKey, paymentHash []byte) (*InvoiceSecrets, error) {
+
+	paymentSecret := randomBytes(32)
+
+	levels := randomBytes(8)
+	l1 := binary.LittleEndian.Uint32(levels[:4]) & 0x7FFFFFFF
+	l2 := binary.LittleEndian.Uint32(levels[4:]) & 0x7FFFFFFF
+
+	keyPath := hdpath.MustParse("m/schema:1'/recovery:1'/invoices:4").Child(l1).Child(l2)
+
+	identityKeyPath := keyPath.Child(identityKeyChildIndex)
+
+	identityKey, err := userKey.DeriveTo(identityKeyPath.String())
+	if err != nil {
+		return nil, err
+	}
+
+	htlcKeyPath := keyPath.Child(htlcKeyChildIndex)
+
+	userHtlcKey, err := userKey.DeriveTo(htlcKeyPath.String())
+	if err != nil {
+		return nil, err
+	}
+	muunHtlcKey, err := muunKey.DeriveTo(htlcKeyPath.String())
+	if err != nil {
+		return nil, err
+	}
+
+	shortChanId := binary.LittleEndian.Uint64(randomBytes(8)) | (1 << 63)
+
+	return &InvoiceSecrets{
+		paymentSecret: paymentSecret,
+		keyPath:       keyPath.String(),
+		PaymentHash:   paymentHash,
+		IdentityKey:   identityKey,
+		UserHtlcKey:   userHtlcKey,
+		MuunHtlcKey:   muunHtlcKey,
+		ShortChanId:   int64(shortChanId),
+	}, nil
+}
+
+// PersistHoldInvoiceSecrets stores a hold invoice secret registered with
+// the remote server in the device local database.
+func PersistHoldInvoiceSecrets(s *InvoiceSecrets) error {
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return db.CreateInvoice(&walletdb.Invoice{
+		PaymentHash:   s.PaymentHash,
+		PaymentSecret: s.paymentSecret,
+		KeyPath:       s.keyPath,
+		ShortChanId:   uint64(s.ShortChanId),
+		State:         walletdb.InvoiceStateRegistered,
+		IsHold:        true,
+	})
+}
+
 // PersistInvoiceSecrets stores secrets registered with the remote server
 // in the device local database. These secrets can be used to craft new
 // Lightning invoices.
@@ -180,50 +315,72 @@ func PersistInvoiceSecrets(list *InvoiceSecretsList) error {
 	return nil
 }
 
-// CreateInvoice returns a new lightning invoice string for the given network.
-// Amount and description can be configured optionally.
-func CreateInvoice(net *Network, userKey *HDPrivateKey, routeHints *RouteHints, opts *InvoiceOptions) (string, error) {
-	// obtain first unused secret from db
-	db, err := openDB()
-	if err != nil {
-		return "", err
-	}
-	defer db.Close()
+// InvoiceSigner abstracts away the identity key used to sign outgoing
+// invoices, so CreateInvoiceWithSigner can use either a local xpriv or a
+// gomobile-bridged remote/hardware signer.
+type InvoiceSigner interface {
+	// SignCompact signs the pre-hash message msg, hashing it internally.
+	SignCompact(msg []byte) ([]byte, error)
+}
 
-	dbInvoice, err := db.FindFirstUnusedInvoice()
-	if err != nil {
-		return "", err
-	}
-	if dbInvoice == nil {
-		return "", nil
+// hdPrivKeySigner is the InvoiceSigner backing the original CreateInvoice.
+type hdPrivKeySigner struct {
+	key *btcec.PrivateKey
+}
+
+func (s *hdPrivKeySigner) SignCompact(msg []byte) ([]byte, error) {
+	return netann.NewNodeSigner(s.key).SignCompact(msg)
+}
+
+func normalizeExpirySeconds(opts *InvoiceOptions) int64 {
+	if opts.ExpirySeconds == 0 {
+		return DefaultInvoiceExpirySeconds
 	}
+	return opts.ExpirySeconds
+}
 
+// buildInvoice constructs and signs the bech32 payment request for
+// dbInvoice, shared by CreateInvoice and CreateInvoiceWithSigner.
+func buildInvoice(net *Network, dbInvoice *walletdb.Invoice, identityPubKey *btcec.PublicKey, signer InvoiceSigner, routeHints *RouteHintsList, opts *InvoiceOptions) (string, error) {
 	var paymentHash [32]byte
 	copy(paymentHash[:], dbInvoice.PaymentHash)
 
-	nodeID, err := parsePubKey(routeHints.Pubkey)
-	if err != nil {
-		return "", fmt.Errorf("can't parse route hint pubkey: %w", err)
-	}
-
 	var iopts []func(*zpay32.Invoice)
-	iopts = append(iopts, zpay32.RouteHint([]zpay32.HopHint{
-		{
-			NodeID:                    nodeID,
-			ChannelID:                 dbInvoice.ShortChanId,
-			FeeBaseMSat:               uint32(routeHints.FeeBaseMsat),
-			FeeProportionalMillionths: uint32(routeHints.FeeProportionalMillionths),
-			CLTVExpiryDelta:           uint16(routeHints.CltvExpiryDelta),
-		},
-	}))
+	for i := 0; i < routeHints.Length(); i++ {
+		hint := routeHints.Get(i)
+
+		nodeID, err := parsePubKey(hint.Pubkey)
+		if err != nil {
+			return "", fmt.Errorf("can't parse route hint pubkey: %w", err)
+		}
+
+		iopts = append(iopts, zpay32.RouteHint([]zpay32.HopHint{
+			{
+				NodeID:                    nodeID,
+				ChannelID:                 uint64(hint.ChannelID),
+				FeeBaseMSat:               uint32(hint.FeeBaseMsat),
+				FeeProportionalMillionths: uint32(hint.FeeProportionalMillionths),
+				CLTVExpiryDelta:           uint16(hint.CltvExpiryDelta),
+			},
+		}))
+	}
 
 	features := lnwire.EmptyFeatureVector()
 	features.RawFeatureVector.Set(lnwire.TLVOnionPayloadOptional)
 	features.RawFeatureVector.Set(lnwire.PaymentAddrOptional)
+	if opts.Features&InvoiceFeatureMPPOptional != 0 {
+		features.RawFeatureVector.Set(lnwire.MPPOptional)
+	}
+	if opts.Features&InvoiceFeatureAMPOptional != 0 {
+		features.RawFeatureVector.Set(lnwire.AMPOptional)
+	}
 
 	iopts = append(iopts, zpay32.Features(features))
 	iopts = append(iopts, zpay32.CLTVExpiry(72)) // ~1/2 day
-	iopts = append(iopts, zpay32.Expiry(1*time.Hour))
+	iopts = append(iopts, zpay32.Expiry(time.Duration(normalizeExpirySeconds(opts))*time.Second))
+	if identityPubKey != nil {
+		iopts = append(iopts, zpay32.Destination(identityPubKey))
+	}
 
 	var paymentAddr [32]byte
 	copy(paymentAddr[:], dbInvoice.PaymentSecret)
@@ -248,6 +405,77 @@ func CreateInvoice(net *Network, userKey *HDPrivateKey, routeHints *RouteHints,
 		return "", err
 	}
 
+	// sign the invoice with the identity key
+	return invoice.Encode(zpay32.MessageSigner{
+		SignCompact: signer.SignCompact,
+	})
+}
+
+// persistUsedInvoice saves the bookkeeping fields CreateInvoice and
+// CreateInvoiceWithSigner set on a dbInvoice once it's been handed out.
+// dbInvoice.IsHold is left untouched: it was already set correctly when the
+// secret was persisted, and opts.IsHold only selects which secret to use.
+func persistUsedInvoice(db *walletdb.DB, dbInvoice *walletdb.Invoice, opts *InvoiceOptions) error {
+	now := time.Now()
+	dbInvoice.AmountSat = opts.AmountSat
+	dbInvoice.State = walletdb.InvoiceStateUsed
+	dbInvoice.UsedAt = &now
+	// persisted so callers (e.g. the sweeper, MPP accounting) don't need to
+	// re-decode the bech32 payment request to recover these
+	dbInvoice.FinalCltvDelta = 72
+	dbInvoice.Expiry = normalizeExpirySeconds(opts)
+	dbInvoice.MPPTotalAmt = opts.MPPTotalAmt
+	dbInvoice.MPPMinShardMsat = opts.MPPMinShardMsat
+
+	return db.SaveInvoice(dbInvoice)
+}
+
+// findUnusedInvoice returns the registered invoice secret to build opts
+// into a bech32 invoice. A hold invoice must be selected by its exact
+// PaymentHash, since that hash is assigned externally and can't be
+// recovered by grabbing an arbitrary unused row; a regular invoice falls
+// back to whichever unused secret sorts first.
+func findUnusedInvoice(db *walletdb.DB, opts *InvoiceOptions) (*walletdb.Invoice, error) {
+	if !opts.IsHold {
+		return db.FindFirstUnusedInvoice()
+	}
+
+	if len(opts.PaymentHash) == 0 {
+		return nil, errors.New("hold invoices must be created with opts.PaymentHash set")
+	}
+
+	dbInvoice, err := db.FindByPaymentHash(opts.PaymentHash)
+	if err != nil {
+		return nil, err
+	}
+	if dbInvoice == nil || !dbInvoice.IsHold || dbInvoice.State != walletdb.InvoiceStateRegistered {
+		return nil, errors.New("no unused hold invoice secret for payment hash")
+	}
+
+	return dbInvoice, nil
+}
+
+// CreateInvoice returns a new lightning invoice string for the given
+// network, signed by the in-process identity key derived from userKey. It
+// shares invoice building and bookkeeping with CreateInvoiceWithSigner
+// through buildInvoice and persistUsedInvoice, but does not call
+// CreateInvoiceWithSigner itself.
+func CreateInvoice(net *Network, userKey *HDPrivateKey, routeHints *RouteHintsList, opts *InvoiceOptions) (string, error) {
+	// obtain the unused secret to build from db
+	db, err := openDB()
+	if err != nil {
+		return "", err
+	}
+	defer db.Close()
+
+	dbInvoice, err := findUnusedInvoice(db, opts)
+	if err != nil {
+		return "", err
+	}
+	if dbInvoice == nil {
+		return "", nil
+	}
+
 	// recreate the client identity privkey
 	identityKeyPath := hdpath.MustParse(dbInvoice.KeyPath).Child(identityKeyChildIndex)
 	identityHDKey, err := userKey.DeriveTo(identityKeyPath.String())
@@ -259,19 +487,14 @@ func CreateInvoice(net *Network, userKey *HDPrivateKey, routeHints *RouteHints,
 		return "", fmt.Errorf("can't obtain identity privkey: %w", err)
 	}
 
-	// sign the invoice with the identity pubkey
-	signer := netann.NewNodeSigner(identityKey)
-	bech32, err := invoice.Encode(zpay32.MessageSigner{
-		SignCompact: signer.SignDigestCompact,
-	})
+	bech32, err := buildInvoice(net, dbInvoice, identityKey.PubKey(), &hdPrivKeySigner{key: identityKey}, routeHints, opts)
 	if err != nil {
 		return "", err
 	}
 
-	now := time.Now()
-	dbInvoice.AmountSat = opts.AmountSat
-	dbInvoice.State = walletdb.InvoiceStateUsed
-	dbInvoice.UsedAt = &now
+	if err := persistUsedInvoice(db, dbInvoice, opts); err != nil {
+		return "", err
+	}
 
 	var metadata *OperationMetadata
 	if opts.Metadata != nil {
@@ -287,8 +510,10 @@ func CreateInvoice(net *Network, userKey *HDPrivateKey, routeHints *RouteHints,
 		if err != nil {
 			return "", fmt.Errorf("failed to encode metadata json: %w", err)
 		}
-		// encryption key is derived at 3/x/y with x and y random indexes
-		key, err := deriveMetadataEncryptionKey(userKey)
+		// encryption key is derived at 3/x'/y' with x and y securely random
+		// hardened indexes; the path is stored alongside the blob since it
+		// can't be recomputed later
+		key, keyPath, err := deriveMetadataEncryptionKey(userKey)
 		if err != nil {
 			return "", fmt.Errorf("failed to derive encryption key: %w", err)
 		}
@@ -297,6 +522,7 @@ func CreateInvoice(net *Network, userKey *HDPrivateKey, routeHints *RouteHints,
 			return "", fmt.Errorf("failed to encrypt metadata: %w", err)
 		}
 		dbInvoice.Metadata = encryptedMetadata
+		dbInvoice.MetadataKeyPath = keyPath
 	}
 
 	err = db.SaveInvoice(dbInvoice)
@@ -307,18 +533,316 @@ func CreateInvoice(net *Network, userKey *HDPrivateKey, routeHints *RouteHints,
 	return bech32, nil
 }
 
-func deriveMetadataEncryptionKey(key *HDPrivateKey) (*HDPrivateKey, error) {
-	key, err := key.DerivedAt(encryptedMetadataKeyChildIndex, false)
+// CreateInvoiceWithSigner is like CreateInvoice but signs through signer
+// instead of a locally-held identity HDPrivateKey, so the identity xpriv
+// never has to enter the mobile process. Encrypted metadata isn't
+// supported through this entry point; use CreateInvoice for that.
+func CreateInvoiceWithSigner(net *Network, identityPubKey *HDPublicKey, signer InvoiceSigner, routeHints *RouteHintsList, opts *InvoiceOptions) (string, error) {
+	if opts.Metadata != nil {
+		return "", errors.New("encrypted metadata isn't supported through CreateInvoiceWithSigner")
+	}
+
+	db, err := openDB()
+	if err != nil {
+		return "", err
+	}
+	defer db.Close()
+
+	dbInvoice, err := findUnusedInvoice(db, opts)
+	if err != nil {
+		return "", err
+	}
+	if dbInvoice == nil {
+		return "", nil
+	}
+
+	var pubKey *btcec.PublicKey
+	if identityPubKey != nil {
+		pubKey, err = identityPubKey.key.ECPubKey()
+		if err != nil {
+			return "", fmt.Errorf("can't obtain identity pubkey: %w", err)
+		}
+	}
+
+	bech32, err := buildInvoice(net, dbInvoice, pubKey, signer, routeHints, opts)
+	if err != nil {
+		return "", err
+	}
+
+	if err := persistUsedInvoice(db, dbInvoice, opts); err != nil {
+		return "", err
+	}
+
+	return bech32, nil
+}
+
+// SettleHoldInvoice releases a hold invoice by revealing its preimage,
+// transitioning it from InvoiceStateAccepted to InvoiceStateSettled.
+func SettleHoldInvoice(paymentHash, preimage []byte) error {
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	dbInvoice, err := db.FindByPaymentHash(paymentHash)
+	if err != nil {
+		return err
+	}
+	if dbInvoice == nil {
+		return errors.New("invoice not found")
+	}
+	if !dbInvoice.IsHold {
+		return errors.New("invoice is not a hold invoice")
+	}
+	if !canSettleHold(dbInvoice.State) {
+		return fmt.Errorf("can't settle invoice in state %v", dbInvoice.State)
+	}
+
+	hash := sha256.Sum256(preimage)
+	if !bytes.Equal(hash[:], paymentHash) {
+		return errors.New("preimage does not match payment hash")
+	}
+
+	now := time.Now()
+	dbInvoice.Preimage = preimage
+	dbInvoice.State = walletdb.InvoiceStateSettled
+	dbInvoice.SettledAt = &now
+
+	return db.SaveInvoice(dbInvoice)
+}
+
+// CancelHoldInvoice cancels a hold invoice that hasn't been settled yet,
+// transitioning it to InvoiceStateCancelled.
+func CancelHoldInvoice(paymentHash []byte) error {
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	dbInvoice, err := db.FindByPaymentHash(paymentHash)
+	if err != nil {
+		return err
+	}
+	if dbInvoice == nil {
+		return errors.New("invoice not found")
+	}
+	if !dbInvoice.IsHold {
+		return errors.New("invoice is not a hold invoice")
+	}
+	if !canCancelHold(dbInvoice.State) {
+		return errors.New("can't cancel a settled invoice")
+	}
+
+	dbInvoice.State = walletdb.InvoiceStateCancelled
+
+	return db.SaveInvoice(dbInvoice)
+}
+
+// canSettleHold reports whether a hold invoice in state can move to
+// InvoiceStateSettled.
+func canSettleHold(state walletdb.InvoiceState) bool {
+	return state == walletdb.InvoiceStateAccepted
+}
+
+// canCancelHold reports whether a hold invoice in state can move to
+// InvoiceStateCancelled.
+func canCancelHold(state walletdb.InvoiceState) bool {
+	return state != walletdb.InvoiceStateSettled
+}
+
+// RegisterHtlc records a newly-accepted HTLC against the invoice identified
+// by paymentHash, keyed by its (shortChanId, htlcId) circuit key.
+func RegisterHtlc(paymentHash []byte, shortChanId int64, htlcId uint64, amountMsat int64, expiry uint32, acceptHeight int32) error {
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	dbInvoice, err := db.FindByPaymentHash(paymentHash)
+	if err != nil {
+		return err
+	}
+	if dbInvoice == nil {
+		return errors.New("invoice not found")
+	}
+	if dbInvoice.MPPMinShardMsat != 0 && amountMsat < dbInvoice.MPPMinShardMsat {
+		return fmt.Errorf("htlc amount %d msat is below the invoice's minimum shard of %d msat", amountMsat, dbInvoice.MPPMinShardMsat)
+	}
+
+	if dbInvoice.Htlcs == nil {
+		dbInvoice.Htlcs = make(map[walletdb.CircuitKey]*walletdb.InvoiceHTLC)
+	}
+
+	key := walletdb.CircuitKey{ShortChannelID: shortChanId, HtlcID: htlcId}
+	dbInvoice.Htlcs[key] = &walletdb.InvoiceHTLC{
+		State:        walletdb.InvoiceHTLCStateAccepted,
+		AcceptTime:   time.Now(),
+		AcceptHeight: acceptHeight,
+		Amt:          amountMsat,
+		Expiry:       expiry,
+	}
+
+	return db.SaveInvoice(dbInvoice)
+}
+
+// SettleHtlc marks the HTLC identified by (shortChanId, htlcId) as settled.
+// Once the invoice's HTLCs sum to its required amount, a regular invoice
+// moves straight to InvoiceStateSettled and its preimage is returned for
+// the caller to release on the wire; a hold invoice only moves to
+// InvoiceStateAccepted, with a nil preimage, since releasing it is
+// SettleHoldInvoice's job. Until then, a nil preimage is returned while
+// the remaining shards are awaited.
+func SettleHtlc(paymentHash []byte, shortChanId int64, htlcId uint64) ([]byte, error) {
+	db, err := openDB()
 	if err != nil {
 		return nil, err
 	}
-	key, err = key.DerivedAt(int64(rand.Int()), false)
+	defer db.Close()
+
+	dbInvoice, err := db.FindByPaymentHash(paymentHash)
 	if err != nil {
 		return nil, err
 	}
-	return key.DerivedAt(int64(rand.Int()), false)
+	if dbInvoice == nil {
+		return nil, errors.New("invoice not found")
+	}
+
+	key := walletdb.CircuitKey{ShortChannelID: shortChanId, HtlcID: htlcId}
+	htlc, ok := dbInvoice.Htlcs[key]
+	if !ok {
+		return nil, errors.New("htlc not registered for this invoice")
+	}
+
+	htlc.State = walletdb.InvoiceHTLCStateSettled
+	htlc.ResolveTime = time.Now()
+
+	dbInvoice.State = nextStateAfterHtlcSettle(dbInvoice)
+	if err := db.SaveInvoice(dbInvoice); err != nil {
+		return nil, err
+	}
+
+	if dbInvoice.State != walletdb.InvoiceStateSettled {
+		return nil, nil
+	}
+
+	return dbInvoice.Preimage, nil
+}
+
+// nextStateAfterHtlcSettle returns the state dbInvoice should move to once
+// one of its HTLCs has just been marked settled. A regular invoice moves
+// straight to InvoiceStateSettled once its HTLCs sum to the required
+// amount; a hold invoice only moves to InvoiceStateAccepted, since
+// releasing it is SettleHoldInvoice's job. Until the required amount is
+// reached, dbInvoice's current state is returned unchanged, to keep
+// waiting on the remaining shards of a multi-part payment.
+func nextStateAfterHtlcSettle(dbInvoice *walletdb.Invoice) walletdb.InvoiceState {
+	if htlcSetAmtMsat(dbInvoice) < requiredMsat(dbInvoice) {
+		return dbInvoice.State
+	}
+	if dbInvoice.IsHold {
+		return walletdb.InvoiceStateAccepted
+	}
+	return walletdb.InvoiceStateSettled
+}
+
+// htlcSetAmtMsat sums the invoice's accepted or settled HTLC amounts, in
+// millisatoshis.
+func htlcSetAmtMsat(dbInvoice *walletdb.Invoice) int64 {
+	var total int64
+	for _, htlc := range dbInvoice.Htlcs {
+		if htlc.State == walletdb.InvoiceHTLCStateAccepted || htlc.State == walletdb.InvoiceHTLCStateSettled {
+			total += htlc.Amt
+		}
+	}
+	return total
+}
+
+// hasAcceptedHtlc reports whether dbInvoice has an HTLC still Accepted.
+func hasAcceptedHtlc(dbInvoice *walletdb.Invoice) bool {
+	for _, htlc := range dbInvoice.Htlcs {
+		if htlc.State == walletdb.InvoiceHTLCStateAccepted {
+			return true
+		}
+	}
+	return false
+}
+
+// requiredMsat returns the msat amount an invoice's HTLCs must sum to
+// before it can be settled.
+func requiredMsat(dbInvoice *walletdb.Invoice) int64 {
+	if dbInvoice.MPPTotalAmt != 0 {
+		return dbInvoice.MPPTotalAmt
+	}
+	return int64(lnwire.NewMSatFromSatoshis(btcutil.Amount(dbInvoice.AmountSat)))
 }
 
+// CancelHtlc marks the HTLC identified by (shortChanId, htlcId) as
+// cancelled.
+func CancelHtlc(paymentHash []byte, shortChanId int64, htlcId uint64) error {
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	dbInvoice, err := db.FindByPaymentHash(paymentHash)
+	if err != nil {
+		return err
+	}
+	if dbInvoice == nil {
+		return errors.New("invoice not found")
+	}
+
+	key := walletdb.CircuitKey{ShortChannelID: shortChanId, HtlcID: htlcId}
+	htlc, ok := dbInvoice.Htlcs[key]
+	if !ok {
+		return errors.New("htlc not registered for this invoice")
+	}
+
+	now := time.Now()
+	htlc.State = walletdb.InvoiceHTLCStateCancelled
+	htlc.ResolveTime = now
+
+	return db.SaveInvoice(dbInvoice)
+}
+
+// deriveMetadataEncryptionKey derives the key used to encrypt an invoice's
+// metadata, at a path of the form m/3/x'/y' with x and y securely random
+// hardened indices, returning the path alongside the key so it can be
+// persisted for later decryption.
+func deriveMetadataEncryptionKey(key *HDPrivateKey) (*HDPrivateKey, string, error) {
+	key, err := key.DerivedAt(encryptedMetadataKeyChildIndex, false)
+	if err != nil {
+		return nil, "", err
+	}
+
+	idx1 := secureRandomIndex()
+	key, err = key.DerivedAt(idx1, true)
+	if err != nil {
+		return nil, "", err
+	}
+
+	idx2 := secureRandomIndex()
+	key, err = key.DerivedAt(idx2, true)
+	if err != nil {
+		return nil, "", err
+	}
+
+	keyPath := fmt.Sprintf("m/%d/%d'/%d'", encryptedMetadataKeyChildIndex, idx1, idx2)
+	return key, keyPath, nil
+}
+
+// secureRandomIndex returns a secure, non-negative hardened child index.
+func secureRandomIndex() int64 {
+	levels := randomBytes(4)
+	return int64(binary.LittleEndian.Uint32(levels) & 0x7FFFFFFF)
+}
+
+// GetInvoiceMetadata returns the raw, still-encrypted metadata blob stored
+// for the invoice identified by paymentHash.
 func GetInvoiceMetadata(paymentHash []byte) (string, error) {
 	db, err := openDB()
 	if err != nil {
@@ -331,6 +855,116 @@ func GetInvoiceMetadata(paymentHash []byte) (string, error) {
 	return invoice.Metadata, nil
 }
 
+// DecryptInvoiceMetadata decrypts and returns the plaintext JSON metadata
+// stored for the invoice identified by paymentHash.
+func DecryptInvoiceMetadata(userKey *HDPrivateKey, paymentHash []byte) (string, error) {
+	db, err := openDB()
+	if err != nil {
+		return "", err
+	}
+	defer db.Close()
+
+	dbInvoice, err := db.FindByPaymentHash(paymentHash)
+	if err != nil {
+		return "", err
+	}
+	if dbInvoice == nil || dbInvoice.Metadata == "" {
+		return "", nil
+	}
+	if dbInvoice.MetadataKeyPath == "" {
+		// metadata predates MetadataKeyPath and was encrypted under the old
+		// math/rand-derived scheme; it needs a walletdb migration to
+		// re-encrypt it under a recoverable path before it can be decrypted
+		return "", errors.New("metadata was encrypted under the legacy scheme and can't be decrypted")
+	}
+
+	key, err := userKey.DeriveTo(dbInvoice.MetadataKeyPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to derive decryption key: %w", err)
+	}
+
+	plaintext, err := key.Encrypter().Decrypt(dbInvoice.Metadata)
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt metadata: %w", err)
+	}
+
+	return string(plaintext), nil
+}
+
+// ValidateInvoiceNotExpired returns an error if the given bech32-encoded
+// payment request has already expired.
+func ValidateInvoiceNotExpired(net *Network, bech32 string) error {
+	payReq, err := zpay32.Decode(bech32, net.network)
+	if err != nil {
+		return fmt.Errorf("can't decode invoice: %w", err)
+	}
+
+	expiresAt := payReq.Timestamp.Add(payReq.Expiry())
+	if time.Now().After(expiresAt) {
+		return fmt.Errorf("invoice expired at %v", expiresAt)
+	}
+
+	return nil
+}
+
+// SweepInvoices purges used invoices whose expiry has passed and registered
+// secrets whose ShortChanId was superseded, skipping any invoice with an
+// HTLC still accepted, and returns the number of rows deleted.
+func SweepInvoices(now time.Time) (int, error) {
+	db, err := openDB()
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+
+	invoices, err := db.ListInvoices()
+	if err != nil {
+		return 0, err
+	}
+
+	purged := 0
+	for _, dbInvoice := range invoices {
+		if hasAcceptedHtlc(dbInvoice) {
+			// an HTLC is still locked in a channel waiting on this invoice;
+			// never purge it out from under a payment in flight
+			continue
+		}
+
+		switch dbInvoice.State {
+		case walletdb.InvoiceStateUsed:
+			if dbInvoice.Expiry == 0 {
+				// row predates the Expiry field and was never backfilled by a
+				// walletdb migration; without a real value we can't tell if
+				// it's actually expired, so leave it alone rather than purge
+				// every pre-existing invoice on the first sweep after upgrade
+				continue
+			}
+
+			cutoff := dbInvoice.CreatedAt.Add(time.Duration(dbInvoice.Expiry) * time.Second)
+			if cutoff.Before(now) {
+				if err := db.DeleteInvoice(dbInvoice); err != nil {
+					return purged, err
+				}
+				purged++
+			}
+
+		case walletdb.InvoiceStateRegistered:
+			superseded, err := db.IsShortChanIdSuperseded(dbInvoice.ShortChanId)
+			if err != nil {
+				return purged, err
+			}
+			if superseded {
+				if err := db.DeleteInvoice(dbInvoice); err != nil {
+					return purged, err
+				}
+				purged++
+			}
+		}
+	}
+
+	return purged, nil
+}
+
 func openDB() (*walletdb.DB, error) {
 	return walletdb.Open(path.Join(cfg.DataDir, "wallet.db"))
 }
@@ -0,0 +1,144 @@
+package libwallet
+
+import (
+	"testing"
+
+	"github.com/muun/libwallet/walletdb"
+)
+
+func TestCanSettleHold(t *testing.T) {
+	cases := []struct {
+		state walletdb.InvoiceState
+		want  bool
+	}{
+		{walletdb.InvoiceStateAccepted, true},
+		{walletdb.InvoiceStateUsed, false},
+		{walletdb.InvoiceStateSettled, false},
+		{walletdb.InvoiceStateCancelled, false},
+	}
+
+	for _, c := range cases {
+		if got := canSettleHold(c.state); got != c.want {
+			t.Errorf("canSettleHold(%v) = %v, want %v", c.state, got, c.want)
+		}
+	}
+}
+
+func TestCanCancelHold(t *testing.T) {
+	cases := []struct {
+		state walletdb.InvoiceState
+		want  bool
+	}{
+		{walletdb.InvoiceStateAccepted, true},
+		{walletdb.InvoiceStateUsed, true},
+		{walletdb.InvoiceStateSettled, false},
+		{walletdb.InvoiceStateCancelled, true},
+	}
+
+	for _, c := range cases {
+		if got := canCancelHold(c.state); got != c.want {
+			t.Errorf("canCancelHold(%v) = %v, want %v", c.state, got, c.want)
+		}
+	}
+}
+
+func TestHtlcSetAmtMsat(t *testing.T) {
+	dbInvoice := &walletdb.Invoice{
+		Htlcs: map[walletdb.CircuitKey]*walletdb.InvoiceHTLC{
+			{ShortChannelID: 1, HtlcID: 1}: {State: walletdb.InvoiceHTLCStateAccepted, Amt: 1000},
+			{ShortChannelID: 1, HtlcID: 2}: {State: walletdb.InvoiceHTLCStateSettled, Amt: 2000},
+			{ShortChannelID: 1, HtlcID: 3}: {State: walletdb.InvoiceHTLCStateCancelled, Amt: 5000},
+		},
+	}
+
+	if got, want := htlcSetAmtMsat(dbInvoice), int64(3000); got != want {
+		t.Errorf("htlcSetAmtMsat() = %d, want %d", got, want)
+	}
+}
+
+func TestHasAcceptedHtlc(t *testing.T) {
+	withAccepted := &walletdb.Invoice{
+		Htlcs: map[walletdb.CircuitKey]*walletdb.InvoiceHTLC{
+			{ShortChannelID: 1, HtlcID: 1}: {State: walletdb.InvoiceHTLCStateAccepted},
+		},
+	}
+	withoutAccepted := &walletdb.Invoice{
+		Htlcs: map[walletdb.CircuitKey]*walletdb.InvoiceHTLC{
+			{ShortChannelID: 1, HtlcID: 1}: {State: walletdb.InvoiceHTLCStateSettled},
+			{ShortChannelID: 1, HtlcID: 2}: {State: walletdb.InvoiceHTLCStateCancelled},
+		},
+	}
+	empty := &walletdb.Invoice{}
+
+	if !hasAcceptedHtlc(withAccepted) {
+		t.Error("hasAcceptedHtlc() = false, want true")
+	}
+	if hasAcceptedHtlc(withoutAccepted) {
+		t.Error("hasAcceptedHtlc() = true, want false")
+	}
+	if hasAcceptedHtlc(empty) {
+		t.Error("hasAcceptedHtlc() = true, want false")
+	}
+}
+
+func TestRequiredMsat(t *testing.T) {
+	withMPP := &walletdb.Invoice{AmountSat: 1000, MPPTotalAmt: 500000}
+	if got, want := requiredMsat(withMPP), int64(500000); got != want {
+		t.Errorf("requiredMsat() = %d, want %d", got, want)
+	}
+
+	withoutMPP := &walletdb.Invoice{AmountSat: 1000}
+	if got, want := requiredMsat(withoutMPP), int64(1000000); got != want {
+		t.Errorf("requiredMsat() = %d, want %d", got, want)
+	}
+}
+
+func TestNextStateAfterHtlcSettle(t *testing.T) {
+	partial := &walletdb.Invoice{
+		State:     walletdb.InvoiceStateUsed,
+		AmountSat: 1000,
+		Htlcs: map[walletdb.CircuitKey]*walletdb.InvoiceHTLC{
+			{ShortChannelID: 1, HtlcID: 1}: {State: walletdb.InvoiceHTLCStateSettled, Amt: 400000},
+		},
+	}
+	if got, want := nextStateAfterHtlcSettle(partial), walletdb.InvoiceStateUsed; got != want {
+		t.Errorf("nextStateAfterHtlcSettle(partial) = %v, want %v", got, want)
+	}
+
+	completeRegular := &walletdb.Invoice{
+		State:     walletdb.InvoiceStateUsed,
+		AmountSat: 1000,
+		Htlcs: map[walletdb.CircuitKey]*walletdb.InvoiceHTLC{
+			{ShortChannelID: 1, HtlcID: 1}: {State: walletdb.InvoiceHTLCStateSettled, Amt: 1000000},
+		},
+	}
+	if got, want := nextStateAfterHtlcSettle(completeRegular), walletdb.InvoiceStateSettled; got != want {
+		t.Errorf("nextStateAfterHtlcSettle(completeRegular) = %v, want %v", got, want)
+	}
+
+	completeHold := &walletdb.Invoice{
+		State:     walletdb.InvoiceStateUsed,
+		IsHold:    true,
+		AmountSat: 1000,
+		Htlcs: map[walletdb.CircuitKey]*walletdb.InvoiceHTLC{
+			{ShortChannelID: 1, HtlcID: 1}: {State: walletdb.InvoiceHTLCStateSettled, Amt: 1000000},
+		},
+	}
+	if got, want := nextStateAfterHtlcSettle(completeHold), walletdb.InvoiceStateAccepted; got != want {
+		t.Errorf("nextStateAfterHtlcSettle(completeHold) = %v, want %v", got, want)
+	}
+}
+
+func TestSecureRandomIndex(t *testing.T) {
+	seen := make(map[int64]bool)
+	for i := 0; i < 100; i++ {
+		idx := secureRandomIndex()
+		if idx < 0 {
+			t.Fatalf("secureRandomIndex() = %d, want non-negative", idx)
+		}
+		seen[idx] = true
+	}
+	if len(seen) < 2 {
+		t.Error("secureRandomIndex() returned the same value on every call")
+	}
+}